@@ -0,0 +1,359 @@
+// auth.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenTTL - как долго одноразовый токен, выданный /login, остаётся действительным.
+const tokenTTL = 2 * time.Minute
+
+// ErrInvalidToken возвращается, когда токен не найден, уже использован или истёк.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Token - одноразовый билет на подключение к WebSocket для конкретного
+// пользователя и комнаты.
+type Token struct {
+	Value     string
+	Username  string
+	Room      string
+	ExpiresAt time.Time
+	Consumed  bool
+}
+
+// TokensRepo - хранилище одноразовых токенов (см. lets-go-chat).
+type TokensRepo interface {
+	// Issue выпускает новый токен для username в комнате room.
+	Issue(username, room string) (Token, error)
+	// Consume находит токен по значению, помечает его использованным и
+	// возвращает его. Возвращает ErrInvalidToken, если токен не найден,
+	// уже использован или истёк.
+	Consume(value string) (Token, error)
+}
+
+// InMemoryTokensRepo - TokensRepo на основе map, подходит для одного инстанса.
+type InMemoryTokensRepo struct {
+	mu     sync.Mutex
+	tokens map[string]*Token
+}
+
+func NewInMemoryTokensRepo() *InMemoryTokensRepo {
+	return &InMemoryTokensRepo{tokens: make(map[string]*Token)}
+}
+
+func (t *InMemoryTokensRepo) Issue(username, room string) (Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tok := &Token{
+		Value:     uuid.NewString(),
+		Username:  username,
+		Room:      room,
+		ExpiresAt: time.Now().Add(tokenTTL),
+	}
+	t.tokens[tok.Value] = tok
+	return *tok, nil
+}
+
+func (t *InMemoryTokensRepo) Consume(value string) (Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tok, ok := t.tokens[value]
+	if !ok || tok.Consumed || time.Now().After(tok.ExpiresAt) {
+		return Token{}, ErrInvalidToken
+	}
+	tok.Consumed = true
+	return *tok, nil
+}
+
+// sessionTTL - как долго сессия, полученная из успешно потреблённого токена,
+// продолжает аутентифицировать последующие HTTP-запросы (например, POST /upload)
+// пока WebSocket-соединение живо.
+const sessionTTL = 30 * time.Minute
+
+// Session - личность, подтверждённая одноразовым токеном при подключении к /ws.
+type Session struct {
+	Username  string
+	Room      string
+	ExpiresAt time.Time
+}
+
+// SessionStore хранит сессии, созданные после потребления токена, чтобы
+// остальные HTTP-эндпоинты (например, /upload) могли доверять username,
+// не принимая его заново от клиента как есть.
+type SessionStore interface {
+	// Create заводит сессию для username в комнате room и возвращает её ID.
+	Create(username, room string) string
+	// Lookup возвращает сессию по ID, если она существует и не истекла.
+	Lookup(sessionID string) (Session, bool)
+	// Revoke завершает сессию, например при отключении клиента.
+	Revoke(sessionID string)
+}
+
+// InMemorySessionStore - SessionStore на основе map, подходит для одного инстанса.
+type InMemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *InMemorySessionStore) Create(username, room string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := uuid.NewString()
+	s.sessions[id] = Session{
+		Username:  username,
+		Room:      room,
+		ExpiresAt: time.Now().Add(sessionTTL),
+	}
+	return id
+}
+
+func (s *InMemorySessionStore) Lookup(sessionID string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[sessionID]
+	if !ok {
+		return Session{}, false
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		delete(s.sessions, sessionID)
+		return Session{}, false
+	}
+	return sess, true
+}
+
+func (s *InMemorySessionStore) Revoke(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionID)
+}
+
+// RoomACL - проверка прав доступа к комнате, выполняемая при регистрации клиента.
+type RoomACL interface {
+	Allowed(room, username string) bool
+}
+
+// OpenRoomACL разрешает любому токену подключаться к любой комнате (поведение по умолчанию).
+type OpenRoomACL struct{}
+
+func (OpenRoomACL) Allowed(room, username string) bool { return true }
+
+// PrivateRoomACL ограничивает комнаты явным списком участников; комнаты,
+// отсутствующие в Members, считаются публичными.
+type PrivateRoomACL struct {
+	mu      sync.RWMutex
+	Members map[string]map[string]bool // room -> username -> allowed
+}
+
+func NewPrivateRoomACL() *PrivateRoomACL {
+	return &PrivateRoomACL{Members: make(map[string]map[string]bool)}
+}
+
+func (a *PrivateRoomACL) Allow(room, username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Members[room] == nil {
+		a.Members[room] = make(map[string]bool)
+	}
+	a.Members[room][username] = true
+}
+
+func (a *PrivateRoomACL) Allowed(room, username string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	members, restricted := a.Members[room]
+	if !restricted {
+		return true
+	}
+	return members[username]
+}
+
+// ErrUsernameTaken возвращается Register, если имя уже занято.
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// ErrPasswordTooLong возвращается Register, если пароль длиннее, чем умеет
+// hash-ить bcrypt (72 байта).
+var ErrPasswordTooLong = errors.New("password must be at most 72 bytes")
+
+// AccountStore - хранилище зарегистрированных пользователей с паролями.
+// Без него /login выдавал бы токен на любое имя без доказательства личности.
+type AccountStore interface {
+	// Register заводит нового пользователя с паролем, либо возвращает
+	// ErrUsernameTaken, если имя уже занято.
+	Register(username, password string) error
+	// Verify проверяет пару логин/пароль.
+	Verify(username, password string) bool
+}
+
+// InMemoryAccountStore - AccountStore на основе map, подходит для одного инстанса.
+type InMemoryAccountStore struct {
+	mu       sync.Mutex
+	accounts map[string][]byte // username -> bcrypt-хеш пароля
+}
+
+func NewInMemoryAccountStore() *InMemoryAccountStore {
+	return &InMemoryAccountStore{accounts: make(map[string][]byte)}
+}
+
+// dummyHash - хеш заведомо не используемого пароля. Verify сравнивает с ним,
+// когда username не найден, чтобы время ответа не выдавало существование
+// аккаунта (bcrypt.CompareHashAndPassword занимает десятки миллисекунд,
+// в отличие от мгновенного промаха по map).
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no-such-account"), bcrypt.DefaultCost)
+
+func (a *InMemoryAccountStore) Register(username, password string) error {
+	if len(password) > 72 {
+		return ErrPasswordTooLong
+	}
+	// Хешируем до захвата mu, чтобы bcrypt (десятки миллисекунд) не сериализовал
+	// параллельные регистрации разных пользователей.
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, exists := a.accounts[username]; exists {
+		return ErrUsernameTaken
+	}
+	a.accounts[username] = hash
+	return nil
+}
+
+func (a *InMemoryAccountStore) Verify(username, password string) bool {
+	a.mu.Lock()
+	hash, ok := a.accounts[username]
+	a.mu.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// registerRequest - тело запроса POST /register.
+type registerRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RegisterHandler - HTTP-обработчик POST /register, заводящий новую учётную запись.
+type RegisterHandler struct {
+	Accounts AccountStore
+}
+
+func NewRegisterHandler(accounts AccountStore) *RegisterHandler {
+	return &RegisterHandler{Accounts: accounts}
+}
+
+func (h *RegisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		http.Error(w, "username and password are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Accounts.Register(req.Username, req.Password); err != nil {
+		switch {
+		case errors.Is(err, ErrUsernameTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, ErrPasswordTooLong):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Register error:", err)
+		http.Error(w, "could not register", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// loginRequest - тело запроса POST /login.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Room     string `json:"room"`
+}
+
+// loginResponse - ответ POST /login с одноразовым токеном и готовым URL для подключения.
+type loginResponse struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// LoginHandler - HTTP-обработчик POST /login, выдающий одноразовый токен для
+// последующего подключения к /ws. Токен выдаётся только после проверки
+// пароля через Accounts - иначе любой мог бы получить токен на чужое имя.
+type LoginHandler struct {
+	Tokens   TokensRepo
+	Accounts AccountStore
+	WsPath   string // например, "/ws"
+}
+
+func NewLoginHandler(tokens TokensRepo, accounts AccountStore, wsPath string) *LoginHandler {
+	return &LoginHandler{Tokens: tokens, Accounts: accounts, WsPath: wsPath}
+}
+
+func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" || req.Room == "" || req.Password == "" {
+		http.Error(w, "username, password and room are required", http.StatusBadRequest)
+		return
+	}
+	if !h.Accounts.Verify(req.Username, req.Password) {
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	tok, err := h.Tokens.Issue(req.Username, req.Room)
+	if err != nil {
+		log.Println("Issue token error:", err)
+		http.Error(w, "could not issue token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := loginResponse{
+		Token: tok.Value,
+		URL:   h.WsPath + "?token=" + tok.Value,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("login response encode error:", err)
+	}
+}
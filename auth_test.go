@@ -0,0 +1,74 @@
+// auth_test.go
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInMemoryTokensRepoConsumeOneTime(t *testing.T) {
+	repo := NewInMemoryTokensRepo()
+
+	tok, err := repo.Issue("alice", "general")
+	if err != nil {
+		t.Fatalf("Issue error: %v", err)
+	}
+
+	got, err := repo.Consume(tok.Value)
+	if err != nil {
+		t.Fatalf("first Consume error: %v", err)
+	}
+	if got.Username != "alice" || got.Room != "general" {
+		t.Fatalf("Consume returned wrong token: %+v", got)
+	}
+
+	if _, err := repo.Consume(tok.Value); err != ErrInvalidToken {
+		t.Fatalf("second Consume should fail with ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestInMemoryTokensRepoConsumeUnknown(t *testing.T) {
+	repo := NewInMemoryTokensRepo()
+
+	if _, err := repo.Consume("does-not-exist"); err != ErrInvalidToken {
+		t.Fatalf("Consume of unknown token should fail with ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestInMemoryAccountStoreRegisterAndVerify(t *testing.T) {
+	store := NewInMemoryAccountStore()
+
+	if err := store.Register("alice", "correct-horse"); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+
+	if !store.Verify("alice", "correct-horse") {
+		t.Fatal("Verify should succeed with the registered password")
+	}
+	if store.Verify("alice", "wrong-password") {
+		t.Fatal("Verify should fail with the wrong password")
+	}
+	if store.Verify("bob", "correct-horse") {
+		t.Fatal("Verify should fail for an unregistered username")
+	}
+}
+
+func TestInMemoryAccountStoreRegisterDuplicate(t *testing.T) {
+	store := NewInMemoryAccountStore()
+
+	if err := store.Register("alice", "correct-horse"); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+	if err := store.Register("alice", "another-password"); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("second Register should fail with ErrUsernameTaken, got %v", err)
+	}
+}
+
+func TestInMemoryAccountStoreRegisterPasswordTooLong(t *testing.T) {
+	store := NewInMemoryAccountStore()
+
+	if err := store.Register("alice", strings.Repeat("a", 73)); !errors.Is(err, ErrPasswordTooLong) {
+		t.Fatalf("Register with a 73-byte password should fail with ErrPasswordTooLong, got %v", err)
+	}
+}
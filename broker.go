@@ -0,0 +1,129 @@
+// broker.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker - абстракция pub-sub транспорта, через который несколько инстансов
+// сервера обмениваются сообщениями комнат. InMemoryBroker подходит для одного
+// инстанса, RedisBroker - для горизонтально масштабируемого деплоя за балансировщиком.
+type Broker interface {
+	Publish(room string, data []byte) error
+	// Subscribe returns a channel of incoming messages for room and a closer
+	// that the caller MUST invoke once it stops reading, to release the
+	// subscription (and, for RedisBroker, the underlying connection).
+	Subscribe(room string) (ch <-chan []byte, closer func(), err error)
+}
+
+// brokerEnvelope оборачивает сообщение комнаты идентификатором инстанса-источника,
+// чтобы получатель мог отличить собственные публикации от чужих.
+type brokerEnvelope struct {
+	OriginID string          `json:"originId"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// --- InMemoryBroker ---
+
+// InMemoryBroker - Broker в пределах одного процесса: повторяет прежнее
+// поведение Hub до появления внешнего pub-sub.
+type InMemoryBroker struct {
+	mu   sync.Mutex
+	subs map[string][]chan []byte
+}
+
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{subs: make(map[string][]chan []byte)}
+}
+
+func (b *InMemoryBroker) Publish(room string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs[room] {
+		select {
+		case ch <- data:
+		default:
+			// Подписчик не успевает читать - сообщение для него пропускается,
+			// чтобы не блокировать публикацию для остальных.
+		}
+	}
+	return nil
+}
+
+func (b *InMemoryBroker) Subscribe(room string) (<-chan []byte, func(), error) {
+	b.mu.Lock()
+	ch := make(chan []byte, 256)
+	b.subs[room] = append(b.subs[room], ch)
+	b.mu.Unlock()
+
+	closer := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subs := b.subs[room]
+		for i, sub := range subs {
+			if sub == ch {
+				b.subs[room] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(b.subs[room]) == 0 {
+			delete(b.subs, room)
+		}
+		close(ch)
+	}
+	return ch, closer, nil
+}
+
+// --- RedisBroker ---
+
+// RedisBroker - Broker поверх Redis PUB/SUB, позволяющий нескольким инстансам
+// сервера доставлять сообщения в одни и те же комнаты.
+type RedisBroker struct {
+	client *redis.Client
+	ctx    context.Context
+	prefix string
+}
+
+func NewRedisBroker(client *redis.Client, prefix string) *RedisBroker {
+	return &RedisBroker{client: client, ctx: context.Background(), prefix: prefix}
+}
+
+func (b *RedisBroker) channel(room string) string {
+	return fmt.Sprintf("%s:room:%s", b.prefix, room)
+}
+
+func (b *RedisBroker) Publish(room string, data []byte) error {
+	return b.client.Publish(b.ctx, b.channel(room), data).Err()
+}
+
+func (b *RedisBroker) Subscribe(room string) (<-chan []byte, func(), error) {
+	pubsub := b.client.Subscribe(b.ctx, b.channel(room))
+	if _, err := pubsub.Receive(b.ctx); err != nil {
+		return nil, nil, fmt.Errorf("subscribe to %s: %w", b.channel(room), err)
+	}
+
+	out := make(chan []byte, 256)
+	go func() {
+		defer close(out)
+		for msg := range pubsub.Channel() {
+			out <- []byte(msg.Payload)
+		}
+	}()
+	// closer закрывает сам SUBSCRIBE у Redis; это останавливает pubsub.Channel(),
+	// что, в свою очередь, завершает горутину выше и закрывает out.
+	closer := func() {
+		if err := pubsub.Close(); err != nil {
+			log.Println("pubsub close error:", err)
+		}
+	}
+	return out, closer, nil
+}
+
+var _ Broker = (*InMemoryBroker)(nil)
+var _ Broker = (*RedisBroker)(nil)
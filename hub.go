@@ -2,12 +2,18 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	_ "github.com/lib/pq"
 )
 
 // --- Модель и интерфейс для работы с данными ---
@@ -21,9 +27,14 @@ type Envelope struct {
 
 // Message - структура сообщения в чате
 type Message struct {
-	Username  string `json:"username"`
-	Text      string `json:"text"`
-	Timestamp int64  `json:"timestamp"`
+	ID         string      `json:"id"`
+	Room       string      `json:"room,omitempty"`
+	Username   string      `json:"username"`
+	Text       string      `json:"text"`
+	Timestamp  int64       `json:"timestamp"`
+	EditedAt   int64       `json:"editedAt,omitempty"`
+	Deleted    bool        `json:"deleted,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
 }
 
 // TypingStatus - структура сообщения User is typing
@@ -32,104 +43,156 @@ type TypingStatus struct {
 	Status bool   `json:"status"`
 }
 
+// EditPayload - payload конверта chat_edit
+type EditPayload struct {
+	MessageID string `json:"messageId"`
+	Text      string `json:"text"`
+}
+
+// DeletePayload - payload конверта chat_delete
+type DeletePayload struct {
+	MessageID string `json:"messageId"`
+}
+
+// ErrForbidden возвращается, когда пользователь пытается изменить чужое сообщение.
+var ErrForbidden = errors.New("only the author can edit or delete this message")
+
 // Repository - интерфейс для работы с хранилищем сообщений
 type Repository interface {
 	SaveMessage(msg Message) error
 	GetLastMessages(room string, count int) ([]Message, error)
+	EditMessage(id, newText, editor string) error
+	DeleteMessage(id, requester string) error
 }
 
 // --- WebSocket часть ---
 
+const (
+	// writeWait - время, отведённое на запись сообщения клиенту.
+	writeWait = 10 * time.Second
+
+	// pongWait - время ожидания pong-ответа от клиента.
+	pongWait = 60 * time.Second
+
+	// pingPeriod - период отправки ping; должен быть меньше pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// maxMessageSize - максимальный размер сообщения от клиента.
+	maxMessageSize = 8192
+)
+
+// AllowedOrigins - белый список Origin, которым разрешено открывать WebSocket-соединение.
+// Пустой срез разрешает любой источник (удобно для локальной разработки, но не для прода).
+var AllowedOrigins []string
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: checkOrigin,
+}
+
+func checkOrigin(r *http.Request) bool {
+	if len(AllowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
 }
 
 // Client - представляет одного WebSocket пользователя.
 type Client struct {
-	conn     *websocket.Conn
-	hub      *Hub
-	send     chan []byte
-	room     string
-	username string
+	conn      *websocket.Conn
+	room      *Room
+	send      chan []byte
+	roomName  string
+	username  string
+	sessionID string
 }
 
-// Hub - управляет всеми клиентами и комнатами.
+// defaultMaxClientsPerRoom - лимит участников комнаты по умолчанию (0 в NewHub отключает проверку).
+const defaultMaxClientsPerRoom = 500
+
+// Hub - реестр комнат. Сама рассылка сообщений происходит внутри каждой Room,
+// поэтому медленная или переполненная комната не блокирует остальные. Broker
+// позволяет нескольким инстансам Hub делить комнаты между собой.
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
-	rooms      map[string]map[*Client]bool
-	db         Repository
+	mu                sync.Mutex
+	rooms             map[string]*Room
+	db                Repository
+	instanceID        string
+	MaxClientsPerRoom int
+	Metrics           Metrics
+	Broker            Broker
+	Tokens            TokensRepo
+	Sessions          SessionStore
+	Accounts          AccountStore
+	ACL               RoomACL
 }
 
 func NewHub(db Repository) *Hub {
 	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		rooms:      make(map[string]map[*Client]bool),
-		db:         db,
+		rooms:             make(map[string]*Room),
+		db:                db,
+		instanceID:        uuid.NewString(),
+		MaxClientsPerRoom: defaultMaxClientsPerRoom,
+		Broker:            NewInMemoryBroker(),
+		Tokens:            NewInMemoryTokensRepo(),
+		Sessions:          NewInMemorySessionStore(),
+		Accounts:          NewInMemoryAccountStore(),
+		ACL:               OpenRoomACL{},
 	}
 }
 
-func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-			if h.rooms[client.room] == nil {
-				h.rooms[client.room] = make(map[*Client]bool)
-			}
-			h.rooms[client.room][client] = true
+// Room возвращает существующую комнату с именем name или создаёт новую и
+// запускает её цикл обработки.
+func (h *Hub) Room(name string) *Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
+	if r, ok := h.rooms[name]; ok {
+		return r
+	}
+	r := newRoom(name, h)
+	h.rooms[name] = r
+	go r.run()
+	go r.subscribeBroker()
+	return r
+}
 
-		case message := <-h.broadcast:
-			var env Envelope
-			if err := json.Unmarshal(message, &env); err != nil {
-				log.Println("unmarshal envelope error:", err)
-				continue
-			}
-			// Сохраняем сообщение в "базу" и ловим ошибки
-			if env.Type == "chat_message" {
-				var msg Message
-				if err := json.Unmarshal(env.Payload, &msg); err == nil {
-					if err := h.db.SaveMessage(msg); err != nil {
-						log.Println("SaveMessage error:", err)
-					}
-				}
-			}
-			// Рассылаем всем в комнате
-			for client := range h.rooms[env.Room] {
-				if _, ok := h.clients[client]; !ok {
-					continue // клиент уже удалён
-				}
-				select {
-				case client.send <- message:
-				default:
-					// Если буфер отправки полон, клиент отключается
-					h.unregister <- client // Отключение клиента через unregister
-				}
-			}
-		}
+// removeRoom убирает опустевшую комнату из реестра. Вызывается самой Room
+// из её run() перед завершением горутины.
+func (h *Hub) removeRoom(name string, r *Room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[name] == r {
+		delete(h.rooms, name)
 	}
 }
 
 // readPump читает сообщения от клиента.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.unregisterFromRoom()
+		c.room.hub.Sessions.Revoke(c.sessionID)
 		c.conn.Close()
-	}() // При ошибке в ReadMessage выходим из readPump, убираем пользователя, закрываем сокет
+	}() // При ошибке в ReadMessage выходим из readPump, убираем пользователя, закрываем сокет, отзываем сессию /upload
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Println("ReadMessage error:", err)
+			}
 			return
 		}
 		// Получаем конверт
@@ -145,7 +208,39 @@ func (c *Client) readPump() {
 			if err := json.Unmarshal(wrap.Payload, &msg); err != nil {
 				log.Println("Unmarshal chat message error:", err)
 			}
+			msg.ID = uuid.NewString()
+			// Имя автора и комната берутся из аутентифицированного клиента, а не
+			// из тела сообщения - иначе любой обладатель токена мог бы подписаться
+			// чужим именем.
+			msg.Username = c.username
+			msg.Room = c.roomName
 			msg.Timestamp = time.Now().Unix()
+			jsonMsg, _ := json.Marshal(struct {
+				Type    string  `json:"type"`
+				Room    string  `json:"room"`
+				Payload Message `json:"payload"`
+			}{
+				Type:    wrap.Type,
+				Room:    c.roomName,
+				Payload: msg,
+			})
+
+			c.room.broadcast <- jsonMsg
+
+		// Вложение, уже загруженное через POST /upload, объявляется в чате
+		case "chat_attachment":
+			var att Attachment
+			if err := json.Unmarshal(wrap.Payload, &att); err != nil {
+				log.Println("Unmarshal attachment error:", err)
+				continue
+			}
+			msg := Message{
+				ID:         att.MessageID,
+				Room:       wrap.Room,
+				Username:   c.username,
+				Timestamp:  time.Now().Unix(),
+				Attachment: &att,
+			}
 			jsonMsg, _ := json.Marshal(struct {
 				Type    string  `json:"type"`
 				Room    string  `json:"room"`
@@ -156,7 +251,92 @@ func (c *Client) readPump() {
 				Payload: msg,
 			})
 
-			c.hub.broadcast <- jsonMsg
+			c.room.broadcast <- jsonMsg
+
+		// Редактирование ранее отправленного сообщения
+		case "chat_edit":
+			var p EditPayload
+			if err := json.Unmarshal(wrap.Payload, &p); err != nil {
+				log.Println("Unmarshal edit payload error:", err)
+				continue
+			}
+			if err := c.room.hub.db.EditMessage(p.MessageID, p.Text, c.username); err != nil {
+				log.Println("EditMessage error:", err)
+				c.sendError(err)
+				continue
+			}
+			jsonMsg, _ := json.Marshal(struct {
+				Type    string      `json:"type"`
+				Room    string      `json:"room"`
+				Payload EditPayload `json:"payload"`
+			}{
+				Type:    wrap.Type,
+				Room:    wrap.Room,
+				Payload: p,
+			})
+
+			c.room.broadcast <- jsonMsg
+
+		// Удаление ранее отправленного сообщения
+		case "chat_delete":
+			var p DeletePayload
+			if err := json.Unmarshal(wrap.Payload, &p); err != nil {
+				log.Println("Unmarshal delete payload error:", err)
+				continue
+			}
+			if err := c.room.hub.db.DeleteMessage(p.MessageID, c.username); err != nil {
+				log.Println("DeleteMessage error:", err)
+				c.sendError(err)
+				continue
+			}
+			jsonMsg, _ := json.Marshal(struct {
+				Type    string        `json:"type"`
+				Room    string        `json:"room"`
+				Payload DeletePayload `json:"payload"`
+			}{
+				Type:    wrap.Type,
+				Room:    wrap.Room,
+				Payload: p,
+			})
+
+			c.room.broadcast <- jsonMsg
+		// Запрос истории сообщений до определённого курсора - ответ идёт только
+		// запросившему клиенту, без рассылки остальным участникам комнаты.
+		case "history_request":
+			var req HistoryRequest
+			if err := json.Unmarshal(wrap.Payload, &req); err != nil {
+				log.Println("Unmarshal history request error:", err)
+				continue
+			}
+			hr, ok := c.room.hub.db.(HistoryRepository)
+			if !ok {
+				c.sendError(errors.New("history is not supported by this repository"))
+				continue
+			}
+			// Комната берётся из аутентифицированного клиента, а не из тела
+			// запроса - иначе любой участник публичной комнаты мог бы запросить
+			// историю чужой (в т.ч. закрытой PrivateRoomACL) комнаты по имени.
+			messages, err := hr.GetMessagesBefore(c.roomName, req.BeforeID, req.Limit)
+			if err != nil {
+				log.Println("GetMessagesBefore error:", err)
+				c.sendError(err)
+				continue
+			}
+			jsonMsg, _ := json.Marshal(struct {
+				Type    string          `json:"type"`
+				Room    string          `json:"room"`
+				Payload HistoryResponse `json:"payload"`
+			}{
+				Type:    "history_response",
+				Room:    c.roomName,
+				Payload: HistoryResponse{Messages: messages},
+			})
+
+			select {
+			case c.send <- jsonMsg:
+			default:
+			}
+
 		// Пользователь печатает, упаковали, отправили
 		case "typing_status":
 			var ts TypingStatus
@@ -174,36 +354,97 @@ func (c *Client) readPump() {
 				Payload: ts,
 			})
 
-			c.hub.broadcast <- jsonMsg
+			c.room.broadcast <- jsonMsg
 
 		}
 	}
 }
 
-// writePump отправляет сообщения клиенту.
+// sendError отправляет клиенту служебный конверт с текстом ошибки.
+func (c *Client) sendError(err error) {
+	jsonMsg, marshalErr := json.Marshal(struct {
+		Type    string `json:"type"`
+		Payload string `json:"payload"`
+	}{
+		Type:    "error",
+		Payload: err.Error(),
+	})
+	if marshalErr != nil {
+		log.Println("sendError marshal error:", marshalErr)
+		return
+	}
+	select {
+	case c.send <- jsonMsg:
+	default:
+	}
+}
+
+// writePump отправляет сообщения клиенту, а также шлёт периодические ping,
+// чтобы обнаруживать "зависшие" (half-open) соединения.
 func (c *Client) writePump() {
-	defer c.conn.Close()
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
 	for {
-		message, ok := <-c.send
-		if !ok {
-			// Канал `send` закрыт.
-			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
-		}
-		err := c.conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			log.Println("WriteMessage error: ")
-			return
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// Канал `send` закрыт.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Println("WriteMessage error:", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("Ping error:", err)
+				return
+			}
 		}
 	}
 }
 
+// unregisterFromRoom убирает клиента из его комнаты. Если комната уже
+// завершила свой run() (опустела раньше), done не даёт здесь заблокироваться навсегда.
+func (c *Client) unregisterFromRoom() {
+	select {
+	case c.room.unregister <- c:
+	case <-c.room.done:
+	}
+}
+
 // serveWs обрабатывает http запрос и обновляет его до WebSocket.
+// Комната и имя пользователя больше не берутся из query-параметров напрямую:
+// они приходят из одноразового токена, выданного POST /login.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	room := r.URL.Query().Get("room")
-	username := r.URL.Query().Get("username")
-	if room == "" || username == "" {
-		http.Error(w, "Room and username are required", http.StatusBadRequest)
+	tokenValue := r.URL.Query().Get("token")
+	if tokenValue == "" {
+		http.Error(w, "token is required", http.StatusUnauthorized)
+		return
+	}
+
+	tok, err := hub.Tokens.Consume(tokenValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	roomName, username := tok.Room, tok.Username
+
+	if hub.ACL != nil && !hub.ACL.Allowed(roomName, username) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	room := hub.Room(roomName)
+	if hub.MaxClientsPerRoom > 0 && room.ClientCount() >= hub.MaxClientsPerRoom {
+		http.Error(w, "room is full", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -214,15 +455,35 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		conn:     conn,
-		hub:      hub,
-		send:     make(chan []byte, 256),
-		room:     room,
-		username: username,
+		conn:      conn,
+		room:      room,
+		send:      make(chan []byte, 256),
+		roomName:  roomName,
+		username:  username,
+		sessionID: hub.Sessions.Create(username, roomName),
+	}
+
+	// Сообщаем клиенту его sessionId - им, а не именем из query-параметра,
+	// он должен подтверждать себя в других HTTP-эндпоинтах (например, POST /upload).
+	sessionMsg, err := json.Marshal(struct {
+		Type    string `json:"type"`
+		Payload struct {
+			SessionID string `json:"sessionId"`
+		} `json:"payload"`
+	}{
+		Type: "session",
+		Payload: struct {
+			SessionID string `json:"sessionId"`
+		}{SessionID: client.sessionID},
+	})
+	if err != nil {
+		log.Println("session envelope marshal error:", err)
+	} else {
+		client.send <- sessionMsg
 	}
 
 	// Получаем последние сообщения
-	lastMessages, err := hub.db.GetLastMessages(client.room, 10)
+	lastMessages, err := hub.db.GetLastMessages(client.roomName, 10)
 	if err != nil {
 		log.Println("GetLastMessages error:", err)
 	} else {
@@ -234,7 +495,7 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 				Payload Message `json:"payload"`
 			}{
 				Type:    "chat_message",
-				Room:    client.room,
+				Room:    client.roomName,
 				Payload: msg,
 			}
 
@@ -248,37 +509,119 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	// Только после этого клиент регистрируется и может получать новые сообщения
-	client.hub.register <- client
+	client.room.register <- client
 
 	go client.writePump()
 	go client.readPump()
 }
 
 // --- Точка входа и мок базы данных ---
-type MockDB struct{}
+
+// MockDB - простое in-memory хранилище, имитирующее реальную базу данных.
+type MockDB struct {
+	mu       sync.Mutex
+	messages map[string][]Message // room -> сообщения в порядке получения
+}
 
 func (m *MockDB) SaveMessage(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.messages == nil {
+		m.messages = make(map[string][]Message)
+	}
+	m.messages[msg.Room] = append(m.messages[msg.Room], msg)
 	log.Printf("Сообщение сохранено: %+v\n", msg)
-	return nil // Всегда успешно
+	return nil
 }
 
 func (m *MockDB) GetLastMessages(room string, count int) ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	log.Printf("Запрошены последние %d сообщений для комнаты %s\n", count, room)
-	// Возвращаем несколько тестовых сообщений
-	return []Message{
-		{Username: "Alice", Text: "Hello!", Timestamp: time.Now().Unix() - 10},
-		{Username: "Bob", Text: "Hi Alice!", Timestamp: time.Now().Unix() - 5},
-	}, nil
+
+	msgs := m.messages[room]
+	if len(msgs) > count {
+		msgs = msgs[len(msgs)-count:]
+	}
+	// Копируем, чтобы вызывающий код не мог случайно повредить внутреннее хранилище.
+	out := make([]Message, len(msgs))
+	copy(out, msgs)
+	return out, nil
+}
+
+func (m *MockDB) EditMessage(id, newText, editor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for room, msgs := range m.messages {
+		for i := range msgs {
+			if msgs[i].ID != id {
+				continue
+			}
+			if msgs[i].Username != editor {
+				return ErrForbidden
+			}
+			msgs[i].Text = newText
+			msgs[i].EditedAt = time.Now().Unix()
+			m.messages[room] = msgs
+			return nil
+		}
+	}
+	return errors.New("message not found")
+}
+
+func (m *MockDB) DeleteMessage(id, requester string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for room, msgs := range m.messages {
+		for i := range msgs {
+			if msgs[i].ID != id {
+				continue
+			}
+			if msgs[i].Username != requester {
+				return ErrForbidden
+			}
+			msgs[i].Deleted = true
+			msgs[i].Text = ""
+			m.messages[room] = msgs
+			return nil
+		}
+	}
+	return errors.New("message not found")
+}
+
+// openRepository подключает SQLRepository, если задан DATABASE_URL, иначе
+// откатывается на MockDB (удобно для локальной разработки без Postgres, но
+// история сообщений в этом случае не переживает перезапуск).
+func openRepository() Repository {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		log.Println("DATABASE_URL не задан, используется MockDB (история не сохраняется между перезапусками)")
+		return &MockDB{}
+	}
+
+	sqlDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatal("sql.Open: ", err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		log.Fatal("sql.Ping: ", err)
+	}
+	return NewSQLRepository(sqlDB)
 }
 
 func main() {
-	db := &MockDB{}
+	db := openRepository()
 	hub := NewHub(db)
-	go hub.Run()
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
+	http.Handle("/register", NewRegisterHandler(hub.Accounts))
+	http.Handle("/login", NewLoginHandler(hub.Tokens, hub.Accounts, "/ws"))
+
+	blobStore := NewLocalBlobStore("./uploads", "/uploads")
+	http.Handle("/upload", NewUploadHandler(blobStore, hub.Sessions))
+	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads"))))
 
 	log.Println("Сервер запущен на :8080")
 	err := http.ListenAndServe(":8080", nil)
@@ -0,0 +1,198 @@
+// room.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+)
+
+// Metrics - хук для отчётности по комнатам (например, экспорт в Prometheus).
+type Metrics interface {
+	RoomClientCount(room string, count int)
+}
+
+// Room - изолированная комната чата со своим циклом рассылки сообщений.
+// Благодаря этому медленная или переполненная комната не блокирует остальные.
+type Room struct {
+	name       string
+	hub        *Hub
+	clients    map[*Client]bool
+	broadcast  chan []byte
+	register   chan *Client
+	unregister chan *Client
+	remote     chan []byte // сообщения, пришедшие из Broker с другого инстанса
+	done       chan struct{}
+	// brokerStopped закрывается после того, как subscribeBroker() освободил
+	// подписку в Broker (closer уже выполнен) - в отличие от done, которая
+	// закрывается в момент решения остановиться, но до фактической очистки.
+	brokerStopped chan struct{}
+	count         atomic.Int32
+}
+
+func newRoom(name string, hub *Hub) *Room {
+	return &Room{
+		name:          name,
+		hub:           hub,
+		clients:       make(map[*Client]bool),
+		broadcast:     make(chan []byte),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		remote:        make(chan []byte, 256),
+		done:          make(chan struct{}),
+		brokerStopped: make(chan struct{}),
+	}
+}
+
+// subscribeBroker подписывается на сообщения комнаты в Broker и перенаправляет
+// их в r.remote, откуда их забирает run(). Подписка освобождается (closer)
+// как только комната опустела и run() закрыл r.done - иначе каждая когда-либо
+// опустевшая комната навсегда удерживала бы горутину и подписчика в Broker.
+// r.brokerStopped закрывается уже после того, как closer() отработал, поэтому
+// именно на него, а не на r.done, нужно ориентироваться, чтобы дождаться
+// фактического освобождения подписки.
+func (r *Room) subscribeBroker() {
+	defer close(r.brokerStopped)
+
+	if r.hub.Broker == nil {
+		return
+	}
+	ch, closer, err := r.hub.Broker.Subscribe(r.name)
+	if err != nil {
+		log.Println("Broker.Subscribe error:", err)
+		return
+	}
+	defer closer()
+
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			var env brokerEnvelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				log.Println("unmarshal broker envelope error:", err)
+				continue
+			}
+			if env.OriginID == r.hub.instanceID {
+				continue // собственная публикация уже доставлена локально
+			}
+			select {
+			case r.remote <- env.Data:
+			case <-r.done:
+				return
+			}
+
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// ClientCount возвращает текущее число клиентов в комнате; безопасно для вызова
+// из любой горутины.
+func (r *Room) ClientCount() int {
+	return int(r.count.Load())
+}
+
+// run обрабатывает регистрацию, отключение и рассылку сообщений для одной комнаты.
+// Завершается и удаляет себя из Hub, когда комната пустеет.
+func (r *Room) run() {
+	defer close(r.done)
+	for {
+		select {
+		case client := <-r.register:
+			r.clients[client] = true
+			r.count.Store(int32(len(r.clients)))
+			r.reportMetrics()
+
+		case client := <-r.unregister:
+			r.drop(client)
+			if len(r.clients) == 0 {
+				r.hub.removeRoom(r.name, r)
+				return
+			}
+
+		case message := <-r.broadcast:
+			// Сообщение пришло от локального клиента - эта копия и есть источник истины,
+			// поэтому именно здесь выполняется персист и публикация в Broker.
+			r.persist(message)
+			r.deliverLocal(message)
+			r.publish(message)
+
+		case message := <-r.remote:
+			// Сообщение пришло из Broker с другого инстанса - персист уже выполнен
+			// на инстансе-источнике, здесь только доставка локальным клиентам.
+			r.deliverLocal(message)
+		}
+	}
+}
+
+// persist разбирает конверт и сохраняет сообщение в Repository, если оно того требует.
+func (r *Room) persist(message []byte) {
+	var env Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		log.Println("unmarshal envelope error:", err)
+		return
+	}
+	if env.Type != "chat_message" && env.Type != "chat_attachment" {
+		return
+	}
+	var msg Message
+	if err := json.Unmarshal(env.Payload, &msg); err != nil {
+		return
+	}
+	if err := r.hub.db.SaveMessage(msg); err != nil {
+		log.Println("SaveMessage error:", err)
+	}
+}
+
+// deliverLocal рассылает уже готовый конверт клиентам, подключённым к этому инстансу.
+func (r *Room) deliverLocal(message []byte) {
+	for client := range r.clients {
+		select {
+		case client.send <- message:
+		default:
+			// Буфер отправки полон - не блокируем комнату, отключаем медленного клиента на месте.
+			r.drop(client)
+		}
+	}
+}
+
+// publish пересылает сообщение в Broker, помечая его ID текущего инстанса,
+// чтобы другие инстансы могли доставить его своим клиентам этой же комнаты.
+func (r *Room) publish(message []byte) {
+	if r.hub.Broker == nil {
+		return
+	}
+	wrapped, err := json.Marshal(brokerEnvelope{
+		OriginID: r.hub.instanceID,
+		Data:     message,
+	})
+	if err != nil {
+		log.Println("marshal broker envelope error:", err)
+		return
+	}
+	if err := r.hub.Broker.Publish(r.name, wrapped); err != nil {
+		log.Println("Broker.Publish error:", err)
+	}
+}
+
+// drop удаляет клиента из комнаты и закрывает его send-канал. Вызывается только
+// из run(), поэтому безопасна для прямой работы с картой clients.
+func (r *Room) drop(client *Client) {
+	if _, ok := r.clients[client]; !ok {
+		return
+	}
+	delete(r.clients, client)
+	close(client.send)
+	r.count.Store(int32(len(r.clients)))
+	r.reportMetrics()
+}
+
+func (r *Room) reportMetrics() {
+	if r.hub.Metrics != nil {
+		r.hub.Metrics.RoomClientCount(r.name, len(r.clients))
+	}
+}
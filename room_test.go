@@ -0,0 +1,84 @@
+// room_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRoomEmptyRoomGCReleasesBrokerSubscription проверяет, что когда комната
+// пустеет, run() завершается, Hub забывает о ней, и Broker.Subscribe, открытый
+// для неё subscribeBroker(), освобождается - иначе каждая когда-либо опустевшая
+// комната навсегда удерживала бы горутину и запись в InMemoryBroker.subs.
+func TestRoomEmptyRoomGCReleasesBrokerSubscription(t *testing.T) {
+	hub := NewHub(&MockDB{})
+	broker := hub.Broker.(*InMemoryBroker)
+
+	room := hub.Room("lobby")
+	client := &Client{send: make(chan []byte, 1)}
+
+	room.register <- client
+	room.unregister <- client
+
+	select {
+	case <-room.done:
+	case <-time.After(time.Second):
+		t.Fatal("room.run() did not exit after last client left")
+	}
+
+	// room.done закрывается до того, как closer() в subscribeBroker() успевает
+	// отработать (это отдельная горутина) - ждём brokerStopped, которая
+	// закрывается только после фактического освобождения подписки.
+	select {
+	case <-room.brokerStopped:
+	case <-time.After(time.Second):
+		t.Fatal("subscribeBroker() did not release its subscription after done closed")
+	}
+
+	hub.mu.Lock()
+	_, stillTracked := hub.rooms["lobby"]
+	hub.mu.Unlock()
+	if stillTracked {
+		t.Fatal("Hub still tracks an empty room after GC")
+	}
+
+	broker.mu.Lock()
+	subs := broker.subs["lobby"]
+	broker.mu.Unlock()
+	if len(subs) != 0 {
+		t.Fatalf("InMemoryBroker still has %d subscriber(s) for a GC'd room", len(subs))
+	}
+}
+
+// TestRoomSurvivesWhileClientsRemain проверяет, что комната не удаляется из Hub,
+// пока в ней остаётся хотя бы один клиент.
+func TestRoomSurvivesWhileClientsRemain(t *testing.T) {
+	hub := NewHub(&MockDB{})
+	room := hub.Room("lobby")
+
+	first := &Client{send: make(chan []byte, 1)}
+	second := &Client{send: make(chan []byte, 1)}
+
+	room.register <- first
+	room.register <- second
+	room.unregister <- first
+
+	deadline := time.After(time.Second)
+	for {
+		if room.ClientCount() == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected 1 client left, got %d", room.ClientCount())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	hub.mu.Lock()
+	_, stillTracked := hub.rooms["lobby"]
+	hub.mu.Unlock()
+	if !stillTracked {
+		t.Fatal("Hub dropped a room that still has a client")
+	}
+}
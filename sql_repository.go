@@ -0,0 +1,190 @@
+// sql_repository.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HistoryRequest - payload конверта history_request.
+type HistoryRequest struct {
+	Room     string `json:"room"`
+	BeforeID string `json:"beforeId"`
+	Limit    int    `json:"limit"`
+}
+
+// HistoryResponse - payload конверта history_response.
+type HistoryResponse struct {
+	Messages []Message `json:"messages"`
+}
+
+// HistoryRepository - Repository, дополнительно умеющий отдавать историю
+// постранично (курсором beforeID) вместо фиксированных 10 последних сообщений.
+type HistoryRepository interface {
+	Repository
+	GetMessagesBefore(room, beforeID string, count int) ([]Message, error)
+}
+
+// defaultHistoryLimit - лимит по умолчанию, если клиент не прислал Limit.
+const defaultHistoryLimit = 50
+
+// SQLRepository - Repository поверх database/sql. Запросы написаны под
+// Postgres-плейсхолдеры ($1, $2, ...); для SQLite драйвера их нужно
+// переписать на "?" либо подключить ребиндер (как делает sqlx).
+// Схема таблицы messages - см. migrations/0001_create_messages_table.up.sql.
+type SQLRepository struct {
+	db *sql.DB
+}
+
+func NewSQLRepository(db *sql.DB) *SQLRepository {
+	return &SQLRepository{db: db}
+}
+
+func (s *SQLRepository) SaveMessage(msg Message) error {
+	attachmentJSON, err := marshalAttachment(msg.Attachment)
+	if err != nil {
+		return fmt.Errorf("marshal attachment: %w", err)
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO messages (id, room, username, text, timestamp, edited_at, deleted, attachment)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		msg.ID, msg.Room, msg.Username, msg.Text, msg.Timestamp, msg.EditedAt, msg.Deleted, attachmentJSON,
+	)
+	if err != nil {
+		return fmt.Errorf("insert message: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLRepository) GetLastMessages(room string, count int) ([]Message, error) {
+	rows, err := s.db.Query(
+		`SELECT id, room, username, text, timestamp, edited_at, deleted, attachment
+		 FROM messages WHERE room = $1 ORDER BY seq DESC LIMIT $2`,
+		room, count,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select last messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	reverse(messages)
+	return messages, nil
+}
+
+func (s *SQLRepository) GetMessagesBefore(room, beforeID string, count int) ([]Message, error) {
+	if count <= 0 {
+		count = defaultHistoryLimit
+	}
+
+	var rows *sql.Rows
+	var err error
+	if beforeID == "" {
+		rows, err = s.db.Query(
+			`SELECT id, room, username, text, timestamp, edited_at, deleted, attachment
+			 FROM messages WHERE room = $1 ORDER BY seq DESC LIMIT $2`,
+			room, count,
+		)
+	} else {
+		rows, err = s.db.Query(
+			`SELECT id, room, username, text, timestamp, edited_at, deleted, attachment
+			 FROM messages WHERE room = $1 AND seq < (SELECT seq FROM messages WHERE id = $2)
+			 ORDER BY seq DESC LIMIT $3`,
+			room, beforeID, count,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select messages before %q: %w", beforeID, err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	reverse(messages)
+	return messages, nil
+}
+
+func (s *SQLRepository) EditMessage(id, newText, editor string) error {
+	res, err := s.db.Exec(
+		`UPDATE messages SET text = $1, edited_at = $2 WHERE id = $3 AND username = $4 AND NOT deleted`,
+		newText, time.Now().Unix(), id, editor,
+	)
+	return checkMutationResult(res, err)
+}
+
+func (s *SQLRepository) DeleteMessage(id, requester string) error {
+	res, err := s.db.Exec(
+		`UPDATE messages SET deleted = TRUE, text = '' WHERE id = $1 AND username = $2`,
+		id, requester,
+	)
+	return checkMutationResult(res, err)
+}
+
+// checkMutationResult переводит "0 строк затронуто" в ErrForbidden. Причины
+// (сообщения не существует, автор не совпадает, для EditMessage - сообщение
+// уже удалено) не
+// различаются: в отличие от MockDB, отдельной ошибки "message not found" нет.
+func checkMutationResult(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var attachmentJSON sql.NullString
+		if err := rows.Scan(&msg.ID, &msg.Room, &msg.Username, &msg.Text, &msg.Timestamp, &msg.EditedAt, &msg.Deleted, &attachmentJSON); err != nil {
+			return nil, fmt.Errorf("scan message row: %w", err)
+		}
+		if attachmentJSON.Valid && attachmentJSON.String != "" {
+			var att Attachment
+			if err := json.Unmarshal([]byte(attachmentJSON.String), &att); err != nil {
+				return nil, fmt.Errorf("unmarshal attachment: %w", err)
+			}
+			msg.Attachment = &att
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func marshalAttachment(att *Attachment) (*string, error) {
+	if att == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(att)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// reverse переворачивает messages на месте: запросы выше читают по seq DESC
+// (эффективно с индексом), но клиенты ожидают хронологический порядок.
+func reverse(messages []Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
@@ -0,0 +1,71 @@
+// sql_repository_test.go
+package main
+
+import (
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestSQLRepositoryGetMessagesBeforeFirstPage проверяет первую страницу истории
+// (без курсора): должен уйти запрос без beforeID, а строки - вернуться в
+// хронологическом порядке (reverse() после ORDER BY seq DESC).
+func TestSQLRepositoryGetMessagesBeforeFirstPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"id", "room", "username", "text", "timestamp", "edited_at", "deleted", "attachment"}).
+		AddRow("msg-2", "general", "bob", "second", int64(200), int64(0), false, nil).
+		AddRow("msg-1", "general", "alice", "first", int64(100), int64(0), false, nil)
+
+	mock.ExpectQuery(`(?s)SELECT .* FROM messages WHERE room = \$1 ORDER BY seq DESC LIMIT \$2`).
+		WithArgs("general", 2).
+		WillReturnRows(rows)
+
+	repo := NewSQLRepository(db)
+	messages, err := repo.GetMessagesBefore("general", "", 2)
+	if err != nil {
+		t.Fatalf("GetMessagesBefore error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].ID != "msg-1" || messages[1].ID != "msg-2" {
+		t.Fatalf("expected chronological order msg-1, msg-2, got %s, %s", messages[0].ID, messages[1].ID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// TestSQLRepositoryGetMessagesBeforeCursor проверяет, что указание beforeID
+// уходит в запрос с условием seq < (SELECT seq ... WHERE id = beforeID).
+func TestSQLRepositoryGetMessagesBeforeCursor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"id", "room", "username", "text", "timestamp", "edited_at", "deleted", "attachment"}).
+		AddRow("msg-1", "general", "alice", "first", int64(100), int64(0), false, nil)
+
+	mock.ExpectQuery(`(?s)SELECT .* FROM messages WHERE room = \$1 AND seq < \(SELECT seq FROM messages WHERE id = \$2\)\s+ORDER BY seq DESC LIMIT \$3`).
+		WithArgs("general", "msg-2", 50).
+		WillReturnRows(rows)
+
+	repo := NewSQLRepository(db)
+	messages, err := repo.GetMessagesBefore("general", "msg-2", 0)
+	if err != nil {
+		t.Fatalf("GetMessagesBefore error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != "msg-1" {
+		t.Fatalf("expected [msg-1], got %+v", messages)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
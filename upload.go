@@ -0,0 +1,206 @@
+// upload.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxUploadSize - максимальный размер одного вложения.
+	maxUploadSize = 10 << 20 // 10 MB
+
+	// uploadsPerMinute - сколько вложений пользователь может загрузить в минуту.
+	uploadsPerMinute = 10
+)
+
+// allowedMimeTypes - белый список типов вложений, принимаемых сервером.
+var allowedMimeTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// Attachment - метаданные файла, приложенного к сообщению.
+type Attachment struct {
+	MessageID    string `json:"messageId"`
+	Filename     string `json:"filename"`
+	MimeType     string `json:"mimeType"`
+	Size         int64  `json:"size"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+}
+
+// BlobStore - интерфейс для хранения бинарных вложений (диск, S3 и т.п.).
+type BlobStore interface {
+	// Save сохраняет содержимое r и возвращает публичный URL. filename - исходное
+	// имя файла от клиента; имя, под которым файл хранится, выбирает сам BlobStore
+	// (LocalBlobStore берёт из filename только расширение).
+	Save(filename, mimeType string, r io.Reader) (url string, err error)
+}
+
+// LocalBlobStore - BlobStore, сохраняющий вложения на локальном диске.
+type LocalBlobStore struct {
+	// Dir - директория, в которую складываются файлы.
+	Dir string
+	// BaseURL - префикс, под которым файлы раздаются наружу (например, через http.FileServer).
+	BaseURL string
+}
+
+func NewLocalBlobStore(dir, baseURL string) *LocalBlobStore {
+	return &LocalBlobStore{Dir: dir, BaseURL: baseURL}
+}
+
+func (s *LocalBlobStore) Save(filename, mimeType string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return "", fmt.Errorf("create upload dir: %w", err)
+	}
+
+	storedName := uuid.NewString() + filepath.Ext(filename)
+	dst, err := os.Create(filepath.Join(s.Dir, storedName))
+	if err != nil {
+		return "", fmt.Errorf("create upload file: %w", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, r); err != nil {
+		return "", fmt.Errorf("write upload file: %w", err)
+	}
+
+	return s.BaseURL + "/" + storedName, nil
+}
+
+// limiterIdleTTL - как долго неиспользуемый rate.Limiter пользователя хранится
+// в uploadLimiter, прежде чем быть выметенным. Без этого limiters рос бы
+// бесконечно по мере появления новых аутентифицированных сессий.
+const limiterIdleTTL = 10 * time.Minute
+
+// uploadLimiterEntry - rate.Limiter пользователя вместе с моментом последнего обращения.
+type uploadLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// uploadLimiter - ограничитель частоты загрузок, по одному rate.Limiter на пользователя.
+type uploadLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*uploadLimiterEntry
+}
+
+func newUploadLimiter() *uploadLimiter {
+	return &uploadLimiter{limiters: make(map[string]*uploadLimiterEntry)}
+}
+
+func (l *uploadLimiter) allow(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	entry, ok := l.limiters[username]
+	if !ok {
+		entry = &uploadLimiterEntry{limiter: rate.NewLimiter(rate.Every(time.Minute/uploadsPerMinute), uploadsPerMinute)}
+		l.limiters[username] = entry
+	}
+	entry.lastUsed = now
+	return entry.limiter.Allow()
+}
+
+// sweep удаляет лимитеры пользователей, не обращавшихся дольше limiterIdleTTL.
+// Вызывается только из allow(), уже держащего mu.
+func (l *uploadLimiter) sweep(now time.Time) {
+	for username, entry := range l.limiters {
+		if now.Sub(entry.lastUsed) > limiterIdleTTL {
+			delete(l.limiters, username)
+		}
+	}
+}
+
+// UploadHandler - HTTP-обработчик POST /upload, принимающий multipart-загрузку вложений.
+// Аутентифицированный username берётся из сессии, выданной /ws при подключении,
+// а не из query-параметра - иначе его мог бы подделать кто угодно.
+type UploadHandler struct {
+	Store    BlobStore
+	Sessions SessionStore
+	limiter  *uploadLimiter
+}
+
+func NewUploadHandler(store BlobStore, sessions SessionStore) *UploadHandler {
+	return &UploadHandler{Store: store, Sessions: sessions, limiter: newUploadLimiter()}
+}
+
+func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		http.Error(w, "session is required", http.StatusUnauthorized)
+		return
+	}
+	session, ok := h.Sessions.Lookup(sessionID)
+	if !ok {
+		http.Error(w, "invalid or expired session", http.StatusUnauthorized)
+		return
+	}
+	username := session.Username
+
+	if !h.limiter.allow(username) {
+		http.Error(w, "upload rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	mimeType := header.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(header.Filename))
+	}
+	if !allowedMimeTypes[mimeType] {
+		http.Error(w, "unsupported file type: "+mimeType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	url, err := h.Store.Save(header.Filename, mimeType, file)
+	if err != nil {
+		log.Println("BlobStore.Save error:", err)
+		http.Error(w, "could not store file", http.StatusInternalServerError)
+		return
+	}
+
+	att := Attachment{
+		MessageID: uuid.NewString(),
+		Filename:  header.Filename,
+		MimeType:  mimeType,
+		Size:      header.Size,
+		URL:       url,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(att); err != nil {
+		log.Println("upload response encode error:", err)
+	}
+}